@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// ChunkedCommand is one piece of a Command that was too large to fit in a
+// single LogEntry. Log.appendChunkedCommand splits an encoded Command into a
+// series of these, sharing a GroupID, and Log reassembles them once the
+// final chunk (SeqNum == NumChunks-1) commits. Intermediate chunks are
+// applied as no-ops to the state machine but still count toward
+// commitIndex/appliedIndex like any other entry.
+type ChunkedCommand struct {
+	GroupID   string
+	SeqNum    int
+	NumChunks int
+	Data      []byte
+}
+
+// CommandName returns the name Log uses to recognize a chunk on decode.
+func (c *ChunkedCommand) CommandName() string {
+	return "raft:chunked"
+}
+
+// chunkGroup accumulates the chunks received so far for one GroupID.
+type chunkGroup struct {
+	numChunks int
+	chunks    map[int][]byte
+	baseIndex uint64 // log index of chunk SeqNum 0, so the group's whole span can be checked against a truncation point even for chunks not yet received
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// appendChunkedCommand encodes cmd, splits it into chunks of at most
+// maxChunkBytes, and appends each chunk as its own LogEntry sharing a chunk
+// group ID. Use this instead of createEntry/appendEntry for commands that
+// may exceed a single entry's practical size.
+func (l *Log) appendChunkedCommand(term uint64, cmd Command, maxChunkBytes int) error {
+	if maxChunkBytes <= 0 {
+		return fmt.Errorf("raft.Log: maxChunkBytes must be positive (%v)", maxChunkBytes)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cmd); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	numChunks := (len(data) + maxChunkBytes - 1) / maxChunkBytes
+	if numChunks == 0 {
+		numChunks = 1
+	}
+
+	// The group ID is derived from the encoded command itself rather than
+	// from the log's current index, so a leader retrying the same append
+	// (e.g. after a lost response) while the original attempt's chunks are
+	// still buffered in l.chunkGroups produces the same ID and the retried
+	// chunks just overwrite their slots with identical data. This is
+	// deliberately not used as a cross-attempt dedup key: two distinct
+	// commands that happen to serialize to the same bytes would collide on
+	// it, and there's no way to tell that case apart from a genuine retry
+	// once the first attempt's chunks are gone. A retry whose original
+	// attempt was truncated before committing is therefore applied again.
+	sum := sha256.Sum256(data)
+	groupID := fmt.Sprintf("%x", sum)
+
+	// Reserve a contiguous run of indices up front; createEntry/nextIndex
+	// can't be used per-chunk since nextIndex() only advances once the
+	// entries are actually appended below.
+	base := l.nextIndex()
+
+	entries := make([]*LogEntry, 0, numChunks)
+	for i := 0; i < numChunks; i++ {
+		lo := i * maxChunkBytes
+		hi := lo + maxChunkBytes
+		if hi > len(data) {
+			hi = len(data)
+		}
+
+		chunkData := make([]byte, hi-lo)
+		copy(chunkData, data[lo:hi])
+
+		chunk := &ChunkedCommand{
+			GroupID:   groupID,
+			SeqNum:    i,
+			NumChunks: numChunks,
+			Data:      chunkData,
+		}
+		entries = append(entries, newLogEntry(l, base+uint64(i), term, chunk))
+	}
+
+	return l.appendEntries(entries)
+}
+
+// Apply invokes the state machine on entry via ApplyFunc, transparently
+// reassembling chunked commands. This is what the goroutine draining
+// NextAppliableEntries should call instead of invoking ApplyFunc directly,
+// so that ChunkedCommand entries are buffered rather than applied as-is.
+// ApplyFunc itself runs unlocked so a slow state machine can't stall the
+// commit/replication path, which takes the same lock.
+func (l *Log) Apply(entry *LogEntry) (interface{}, error) {
+	l.mutex.Lock()
+	cmd, done, err := l.bufferChunk(entry)
+	l.mutex.Unlock()
+	if err != nil || done {
+		return nil, err
+	}
+	return l.ApplyFunc(cmd)
+}
+
+// applyCommand is the lock-free core of Apply; it's also used during
+// open()'s replay, which already holds l.mutex for the whole replay loop so
+// ApplyFunc necessarily runs under it there.
+func (l *Log) applyCommand(entry *LogEntry) (interface{}, error) {
+	cmd, done, err := l.bufferChunk(entry)
+	if err != nil || done {
+		return nil, err
+	}
+	return l.ApplyFunc(cmd)
+}
+
+// bufferChunk does the locked bookkeeping shared by Apply and applyCommand:
+// passing non-chunked commands through untouched, and buffering/reassembling
+// ChunkedCommand entries. It returns the command ready to hand to ApplyFunc,
+// with done == true once that's already happened or there's nothing left to
+// do, so callers never invoke ApplyFunc themselves while holding l.mutex.
+func (l *Log) bufferChunk(entry *LogEntry) (cmd Command, done bool, err error) {
+	cc, ok := entry.Command.(*ChunkedCommand)
+	if !ok {
+		return entry.Command, false, nil
+	}
+
+	group, ok := l.chunkGroups[cc.GroupID]
+	if !ok {
+		group = &chunkGroup{
+			numChunks: cc.NumChunks,
+			chunks:    make(map[int][]byte),
+			baseIndex: entry.Index - uint64(cc.SeqNum),
+		}
+		l.chunkGroups[cc.GroupID] = group
+	}
+
+	// Idempotent by (GroupID, SeqNum): a leader retry resends the same
+	// chunk, which just overwrites the slot with identical data.
+	group.chunks[cc.SeqNum] = cc.Data
+
+	if len(group.chunks) < group.numChunks {
+		// Not the final chunk yet; counts toward commit/applied but is a
+		// no-op for the state machine.
+		return nil, true, nil
+	}
+
+	delete(l.chunkGroups, cc.GroupID)
+
+	var buf bytes.Buffer
+	for i := 0; i < group.numChunks; i++ {
+		buf.Write(group.chunks[i])
+	}
+
+	if err := gob.NewDecoder(&buf).Decode(&cmd); err != nil {
+		return nil, true, err
+	}
+	return cmd, false, nil
+}
+
+// dropTruncatedChunkGroups discards any chunk group whose span reaches past
+// index, since that means at least one of its chunks is being truncated from
+// the log and the group can never be completed as originally sent. truncate
+// keeps the entry at index and only discards what follows it, so a group
+// whose last chunk sits exactly at index loses nothing and is left alone. A
+// group's span covers chunks it hasn't received yet too: the chunks already
+// applied (and thus committed) are always the earliest ones in the span, so
+// a still-incomplete group is exactly the case where later, not-yet-applied
+// chunks can be truncated out from under it.
+func (l *Log) dropTruncatedChunkGroups(index uint64) {
+	for groupID, group := range l.chunkGroups {
+		lastIndex := group.baseIndex + uint64(group.numChunks) - 1
+		if lastIndex > index {
+			delete(l.chunkGroups, groupID)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// DirStorage is a Storage implementation that lays the log out as a
+// directory rather than a single file:
+//
+//	<dir>/snap.<term>.<index>  - the most recent snapshot, if any
+//	<dir>/log.<term>.<index>   - the segment holding entries after the
+//	                             snapshot at <term>.<index>
+//
+// Snapshotting replaces both files atomically (write-temp + fsync + rename)
+// so that compaction only has to write the entries surviving the snapshot
+// instead of the whole log, and a crash mid-snapshot can never leave the
+// directory without a readable snapshot+segment pair.
+type DirStorage struct {
+	dir       string
+	segFile   *os.File
+	segPath   string
+	snapPath  string
+	snapTerm  uint64
+	snapIndex uint64
+	entries   []*LogEntry // entries after the snapshot, mirrored on disk in segFile
+
+	// NoSync disables fsyncing the segment file after every Append. It's
+	// on by default (NoSync == false), matching FileStorage.
+	NoSync bool
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// NewDirStorage creates a new directory-based storage.
+func NewDirStorage() *DirStorage {
+	return &DirStorage{
+		entries: make([]*LogEntry, 0),
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Open finds the newest snapshot and segment in the directory (creating the
+// directory if it doesn't exist yet) and opens the segment for appending.
+func (s *DirStorage) Open(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.dir = dir
+
+	snapTerm, snapIndex, snapPath, err := newestSnapshot(dir)
+	if err != nil {
+		return err
+	}
+	s.snapTerm, s.snapIndex, s.snapPath = snapTerm, snapIndex, snapPath
+
+	segPath := filepath.Join(dir, segmentName(snapTerm, snapIndex))
+	s.entries = make([]*LogEntry, 0)
+	if _, err := os.Stat(segPath); err == nil {
+		file, err := os.OpenFile(segPath, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		entries, err := readAllFrames(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		s.entries = entries
+	}
+
+	file, err := os.OpenFile(segPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.segFile = file
+	s.segPath = segPath
+
+	return s.removeStaleFiles()
+}
+
+// Verify scans the active segment and reports the first corrupt frame
+// found, if any; see verifyFrames. The
+// snapshot file itself isn't entry-framed, so it isn't covered here.
+func (s *DirStorage) Verify() ([]CorruptRange, error) {
+	return verifyFrames(s.segPath)
+}
+
+// Close closes the active segment file.
+func (s *DirStorage) Close() error {
+	if s.segFile != nil {
+		err := s.segFile.Close()
+		s.segFile = nil
+		return err
+	}
+	return nil
+}
+
+// FirstIndex returns the index covered by the most recent snapshot (i.e.
+// entries before or at this index are no longer retained), or zero if no
+// snapshot has been taken.
+func (s *DirStorage) FirstIndex() (uint64, error) {
+	return s.snapIndex, nil
+}
+
+// LastIndex returns the index of the newest entry in the active segment, or
+// the snapshot index if the segment is empty.
+func (s *DirStorage) LastIndex() (uint64, error) {
+	if len(s.entries) == 0 {
+		return s.snapIndex, nil
+	}
+	return s.entries[len(s.entries)-1].Index, nil
+}
+
+// Term returns the term of the entry at index.
+func (s *DirStorage) Term(index uint64) (uint64, error) {
+	if index == s.snapIndex {
+		return s.snapTerm, nil
+	}
+	if index < s.snapIndex {
+		return 0, fmt.Errorf("raft.DirStorage: Index compacted away by snapshot (%v): IDX=%v", s.snapIndex, index)
+	}
+	if index > s.snapIndex+uint64(len(s.entries)) {
+		return 0, fmt.Errorf("raft.DirStorage: Index out of range (%v): MAX=%v", index, s.snapIndex+uint64(len(s.entries)))
+	}
+	return s.entries[index-s.snapIndex-1].Term, nil
+}
+
+// Entries returns the entries in the range [lo, hi).
+func (s *DirStorage) Entries(lo, hi uint64) ([]*LogEntry, error) {
+	if lo <= s.snapIndex {
+		return nil, fmt.Errorf("raft.DirStorage: Entry at index has been compacted away by snapshot (%v): IDX=%v", s.snapIndex, lo)
+	}
+	if lo > hi || hi > s.snapIndex+uint64(len(s.entries))+1 {
+		return nil, fmt.Errorf("raft.DirStorage: Invalid range (%v, %v): MAX=%v", lo, hi, s.snapIndex+uint64(len(s.entries)))
+	}
+	return s.entries[lo-s.snapIndex-1 : hi-s.snapIndex-1], nil
+}
+
+// Append writes entries to the end of the active segment.
+func (s *DirStorage) Append(entries []*LogEntry) error {
+	if s.segFile == nil {
+		return errNotOpen
+	}
+	for _, entry := range entries {
+		if err := writeFrame(s.segFile, entry); err != nil {
+			return err
+		}
+	}
+	if !s.NoSync {
+		if err := s.segFile.Sync(); err != nil {
+			return err
+		}
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// Truncate discards entries at or after index, rewriting the active
+// segment. index is relative to the whole log, not the segment.
+func (s *DirStorage) Truncate(index uint64) error {
+	if index <= s.snapIndex {
+		s.entries = []*LogEntry{}
+	} else if index <= s.snapIndex+uint64(len(s.entries)) {
+		s.entries = s.entries[0 : index-s.snapIndex-1]
+	}
+	return s.rewriteSegment(s.entries)
+}
+
+// SaveSnapshot atomically replaces the current snapshot+segment pair with a
+// new snapshot at (term, index) and a fresh, empty segment. Any entries
+// still in the old segment past index are carried forward into the new
+// segment so nothing between the new snapshot and the end of the log is
+// lost.
+func (s *DirStorage) SaveSnapshot(term uint64, index uint64, data []byte) error {
+	var carry []*LogEntry
+	if index < s.snapIndex+uint64(len(s.entries)) {
+		carry = s.entries[index-s.snapIndex:]
+	}
+
+	// The segment is written and renamed into place before the snapshot: if
+	// a crash lands between the two renames, Open() must still find a
+	// complete, readable pair. Snapshot-then-segment would instead let a
+	// crash in that window leave the new snapshot paired with no segment at
+	// all, and Open() silently treats a missing segment as an empty one,
+	// losing every carried (already-committed) entry for good. Doing the
+	// segment first means the worst a crash can do is strand an orphaned
+	// new segment next to the still-intact old snapshot+segment pair, which
+	// Open()/removeStaleFiles clean up without losing anything.
+	newSegPath := filepath.Join(s.dir, segmentName(term, index))
+	tmpSegPath := newSegPath + ".tmp"
+	newSegFile, err := os.OpenFile(tmpSegPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range carry {
+		if err := writeFrame(newSegFile, entry); err != nil {
+			newSegFile.Close()
+			return err
+		}
+	}
+	if err := newSegFile.Sync(); err != nil {
+		newSegFile.Close()
+		return err
+	}
+	if err := os.Rename(tmpSegPath, newSegPath); err != nil {
+		newSegFile.Close()
+		return err
+	}
+
+	newSnapPath := filepath.Join(s.dir, snapshotName(term, index))
+	if err := writeFileAtomic(newSnapPath, data); err != nil {
+		newSegFile.Close()
+		return err
+	}
+
+	oldSegPath, oldSnapPath := s.segPath, s.snapPath
+	if s.segFile != nil {
+		s.segFile.Close()
+	}
+
+	s.segFile, s.segPath = newSegFile, newSegPath
+	s.snapPath = newSnapPath
+	s.snapTerm, s.snapIndex = term, index
+	s.entries = carry
+
+	if oldSegPath != "" && oldSegPath != newSegPath {
+		os.Remove(oldSegPath)
+	}
+	if oldSnapPath != "" && oldSnapPath != newSnapPath {
+		os.Remove(oldSnapPath)
+	}
+	return s.removeStaleFiles()
+}
+
+// LoadSnapshot returns the most recently saved snapshot, if any.
+func (s *DirStorage) LoadSnapshot() (term uint64, index uint64, data []byte, err error) {
+	if s.snapPath == "" {
+		return 0, 0, nil, nil
+	}
+	data, err = ioutil.ReadFile(s.snapPath)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return s.snapTerm, s.snapIndex, data, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Helpers
+//
+//------------------------------------------------------------------------------
+
+// rewriteSegment replaces the active segment file with exactly entries.
+func (s *DirStorage) rewriteSegment(entries []*LogEntry) error {
+	tmpPath := s.segPath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeFrame(file, entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if s.segFile != nil {
+		s.segFile.Close()
+	}
+	if err := os.Rename(tmpPath, s.segPath); err != nil {
+		return err
+	}
+	s.segFile = file
+	return nil
+}
+
+// removeStaleFiles deletes any snap.* / log.* files in the directory other
+// than the currently active pair. This cleans up after a crash that
+// happened between SaveSnapshot's individual remove calls.
+func (s *DirStorage) removeStaleFiles() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(s.dir, name)
+		if path == s.segPath || path == s.snapPath {
+			continue
+		}
+		if strings.HasPrefix(name, "snap.") || strings.HasPrefix(name, "log.") {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path by writing to path+".tmp", fsyncing,
+// and renaming over the destination.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func snapshotName(term, index uint64) string {
+	return fmt.Sprintf("snap.%d.%d", term, index)
+}
+
+func segmentName(term, index uint64) string {
+	return fmt.Sprintf("log.%d.%d", term, index)
+}
+
+// newestSnapshot scans dir for snap.<term>.<index> files and returns the one
+// with the highest index, or zeros if none exist.
+func newestSnapshot(dir string) (term uint64, index uint64, path string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	var best string
+	var bestTerm, bestIndex uint64
+	for _, info := range infos {
+		parts := strings.SplitN(info.Name(), ".", 3)
+		if len(parts) != 3 || parts[0] != "snap" {
+			continue
+		}
+		t, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		i, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		if best == "" || i > bestIndex {
+			best, bestTerm, bestIndex = info.Name(), t, i
+		}
+	}
+
+	if best == "" {
+		return 0, 0, "", nil
+	}
+	return bestTerm, bestIndex, filepath.Join(dir, best), nil
+}
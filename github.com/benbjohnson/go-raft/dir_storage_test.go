@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Regression test: SaveSnapshot used to rename the new snapshot file into
+// place before the new segment file. A crash in that window left a
+// directory with a new snap.<term>.<index> but no matching log.<term>.<index>
+// — Open() treats a missing segment as an empty one, so every carried
+// (already-committed) entry between the old and new snapshot was silently
+// lost. SaveSnapshot now renames the segment first and the snapshot second,
+// so this test simulates a crash right after the segment rename (the only
+// reachable mid-sequence crash point given that ordering) and checks that
+// Open() still recovers every carried entry.
+func TestDirStorage_SaveSnapshotCrashAfterSegmentRenameLosesNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := NewDirStorage()
+	if err := storage.Open(dir); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendViaLog(t, storage, []uint64{1, 1, 1, 1, 1})
+
+	// Establish a baseline snapshot+segment pair the hard way, via the real
+	// (already-fixed) SaveSnapshot, so there's something genuinely at risk
+	// of being lost: entries 3-5, carried forward past the index-2 snapshot.
+	if err := storage.SaveSnapshot(1, 2, []byte("snap-at-2")); err != nil {
+		t.Fatalf("SaveSnapshot(1, 2): %v", err)
+	}
+	if last, err := storage.LastIndex(); err != nil || last != 5 {
+		t.Fatalf("LastIndex after baseline snapshot: got (%v, %v), want (5, nil)", last, err)
+	}
+
+	// Simulate a second SaveSnapshot(2, 4, ...) that crashes right after its
+	// segment rename but before its snapshot file is ever written: hand-roll
+	// just that first half of SaveSnapshot's work.
+	carry := storage.entries[4-storage.snapIndex:]
+	if len(carry) != 1 || carry[0].Index != 5 {
+		t.Fatalf("expected carry to be exactly entry 5, got %d entries", len(carry))
+	}
+
+	newSegPath := filepath.Join(dir, segmentName(2, 4))
+	tmpSegPath := newSegPath + ".tmp"
+	f, err := os.OpenFile(tmpSegPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	for _, entry := range carry {
+		if err := writeFrame(f, entry); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := os.Rename(tmpSegPath, newSegPath); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	// Crash here: snap.2.4 is never written.
+	storage.Close()
+
+	recovered := NewDirStorage()
+	if err := recovered.Open(dir); err != nil {
+		t.Fatalf("Open after simulated crash: %v", err)
+	}
+	defer recovered.Close()
+
+	term, index, data, err := recovered.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if term != 1 || index != 2 || !bytes.Equal(data, []byte("snap-at-2")) {
+		t.Fatalf("LoadSnapshot: got (term=%v, index=%v, data=%q), want the untouched baseline snapshot", term, index, data)
+	}
+
+	last, err := recovered.LastIndex()
+	if err != nil {
+		t.Fatalf("LastIndex: %v", err)
+	}
+	if last != 5 {
+		t.Fatalf("LastIndex: got %v, want 5 (no carried entry lost)", last)
+	}
+
+	entries, err := recovered.Entries(3, 6)
+	if err != nil {
+		t.Fatalf("Entries(3, 6): %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Entries(3, 6): expected all 3 carried entries (3, 4, 5) to survive, got %d", len(entries))
+	}
+}
+
+// Regression test: the converse crash point, once both the segment and
+// snapshot renames have completed but before SaveSnapshot removes the old
+// pair. A crash here must not confuse Open() or removeStaleFiles into
+// picking the stale pair or losing the new one.
+func TestDirStorage_SaveSnapshotCrashAfterBothRenamesLosesNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := NewDirStorage()
+	if err := storage.Open(dir); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendViaLog(t, storage, []uint64{1, 1, 1, 1, 1})
+
+	if err := storage.SaveSnapshot(1, 2, []byte("snap-at-2")); err != nil {
+		t.Fatalf("SaveSnapshot(1, 2): %v", err)
+	}
+
+	carry := storage.entries[4-storage.snapIndex:]
+
+	newSegPath := filepath.Join(dir, segmentName(2, 4))
+	tmpSegPath := newSegPath + ".tmp"
+	f, err := os.OpenFile(tmpSegPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	for _, entry := range carry {
+		if err := writeFrame(f, entry); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := os.Rename(tmpSegPath, newSegPath); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, snapshotName(2, 4)), []byte("snap-at-4")); err != nil {
+		t.Fatalf("writeFileAtomic: %v", err)
+	}
+	// Crash here: both renames landed, but the old snap.1.2/log.1.2 pair is
+	// still on disk since the real SaveSnapshot hadn't reached its cleanup.
+	storage.Close()
+
+	recovered := NewDirStorage()
+	if err := recovered.Open(dir); err != nil {
+		t.Fatalf("Open after simulated crash: %v", err)
+	}
+	defer recovered.Close()
+
+	term, index, data, err := recovered.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if term != 2 || index != 4 || !bytes.Equal(data, []byte("snap-at-4")) {
+		t.Fatalf("LoadSnapshot: got (term=%v, index=%v, data=%q), want the new snapshot", term, index, data)
+	}
+
+	last, err := recovered.LastIndex()
+	if err != nil {
+		t.Fatalf("LastIndex: %v", err)
+	}
+	if last != 5 {
+		t.Fatalf("LastIndex: got %v, want 5 (no carried entry lost)", last)
+	}
+
+	// The stale old-generation pair must be cleaned up, not left behind.
+	if _, err := os.Stat(filepath.Join(dir, segmentName(1, 2))); !os.IsNotExist(err) {
+		t.Fatalf("expected stale segment log.1.2 to be removed, stat err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotName(1, 2))); !os.IsNotExist(err) {
+		t.Fatalf("expected stale snapshot snap.1.2 to be removed, stat err: %v", err)
+	}
+}
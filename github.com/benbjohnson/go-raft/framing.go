@@ -0,0 +1,243 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// frameHeaderSize is the size, in bytes, of the [length][crc32c] header that
+// precedes every encoded entry on disk.
+const frameHeaderSize = 8
+
+// maxFrameSize bounds the length field read from a frame header. It's far
+// larger than any real entry should be; its only job is to keep a corrupt
+// length field (e.g. a flipped bit landing on the header) from triggering a
+// multi-gigabyte allocation before the CRC check ever gets a chance to
+// reject the frame.
+const maxFrameSize = 64 << 20 // 64MB
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptFrame is returned internally when a frame's CRC doesn't match
+// its payload or its header's length field is implausibly large.
+var errCorruptFrame = errors.New("raft: entry frame failed CRC check")
+
+// A CorruptRange describes a span of a log file that failed CRC validation,
+// as reported by Log.Verify().
+type CorruptRange struct {
+	StartOffset int64
+	EndOffset   int64
+	Err         error
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// writeFrame writes entry to w as [uint32 length][uint32 crc32c][entry bytes].
+func writeFrame(w io.Writer, entry *LogEntry) error {
+	var buf bytes.Buffer
+	if err := entry.encode(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(data, crc32cTable))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRawFrame reads one frame's header and payload from r without
+// validating the CRC, returning the raw payload bytes, the header's claimed
+// CRC, and the number of bytes consumed. It returns io.EOF if r is
+// exhausted before any bytes of a new frame are read, and errCorruptFrame
+// if the header's length field is implausibly large to guard against a
+// corrupt length triggering a huge allocation.
+func readRawFrame(r io.Reader) (data []byte, wantCRC uint32, n int, err error) {
+	var header [frameHeaderSize]byte
+	hn, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, 0, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, hn, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	wantCRC = binary.LittleEndian.Uint32(header[4:8])
+
+	if length > maxFrameSize {
+		return nil, 0, hn, errCorruptFrame
+	}
+
+	data = make([]byte, length)
+	dn, err := io.ReadFull(r, data)
+	n = hn + dn
+	if err != nil {
+		return nil, 0, n, err
+	}
+	return data, wantCRC, n, nil
+}
+
+// readFrame reads one framed entry from r, returning the number of bytes
+// consumed. It returns errCorruptFrame if the payload's CRC doesn't match
+// the header, and io.EOF if r is exhausted before any bytes of a new frame
+// are read.
+func readFrame(r io.Reader) (entry *LogEntry, n int, err error) {
+	data, wantCRC, n, err := readRawFrame(r)
+	if err != nil {
+		return nil, n, err
+	}
+
+	if crc32.Checksum(data, crc32cTable) != wantCRC {
+		return nil, n, errCorruptFrame
+	}
+
+	entry = newLogEntry(nil, 0, 0, nil)
+	if _, err := entry.decode(bytes.NewReader(data)); err != nil {
+		return nil, n, err
+	}
+	return entry, n, nil
+}
+
+// containsEmbeddedFrame reports whether data holds a validly-framed entry
+// (a CRC-matching [length][crc32c][payload] triple) starting at any offset.
+// It's used to tell a genuinely corrupt tail record from one whose length
+// field was corrupted into swallowing real, well-framed records that
+// followed it: in the latter case a good record is hiding somewhere inside
+// the over-long payload we failed to validate.
+func containsEmbeddedFrame(data []byte) bool {
+	for i := 0; i+frameHeaderSize <= len(data); i++ {
+		length := binary.LittleEndian.Uint32(data[i : i+4])
+		if length == 0 || length > maxFrameSize {
+			continue
+		}
+		end := i + frameHeaderSize + int(length)
+		if end > len(data) {
+			continue
+		}
+		wantCRC := binary.LittleEndian.Uint32(data[i+4 : i+8])
+		if crc32.Checksum(data[i+frameHeaderSize:end], crc32cTable) == wantCRC {
+			return true
+		}
+	}
+	return false
+}
+
+// readAllFrames reads every framed entry from file, starting at its current
+// offset. If the last record is truncated or fails its CRC check and no
+// further bytes follow it, the file is truncated at the end of the last
+// good record and reading stops there, matching historical recovery
+// behavior. If a bad record is followed by more bytes (i.e. corruption hit
+// the middle of the log, not just the tail), a hard error is returned so a
+// good tail is never silently discarded.
+//
+// "Nothing follows" isn't trusted at face value: a corrupted length field
+// can read past its true payload and swallow whatever well-framed records
+// came after it, which makes the stream look exhausted right at the point
+// a middle-of-log corruption should instead be reported. Before accepting
+// that a bad record is the genuine tail, the bytes it consumed are scanned
+// for an embedded, CRC-valid frame; finding one proves real records were
+// eaten and forces the hard-error path instead.
+func readAllFrames(file *os.File) ([]*LogEntry, error) {
+	reader := bufio.NewReader(file)
+	entries := make([]*LogEntry, 0)
+	var goodOffset int64
+
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+
+		data, wantCRC, n, err := readRawFrame(reader)
+		var entry *LogEntry
+		if err == nil {
+			if crc32.Checksum(data, crc32cTable) != wantCRC {
+				err = errCorruptFrame
+			} else {
+				entry = newLogEntry(nil, 0, 0, nil)
+				_, err = entry.decode(bytes.NewReader(data))
+			}
+		}
+
+		if err != nil {
+			_, peekErr := reader.Peek(1)
+			nothingFollows := peekErr == io.EOF
+			if nothingFollows && containsEmbeddedFrame(data) {
+				nothingFollows = false
+			}
+			if nothingFollows {
+				// Nothing follows the bad record: a crash during the
+				// last write. Safe to truncate and carry on.
+				if truncErr := file.Truncate(goodOffset); truncErr != nil {
+					return nil, fmt.Errorf("raft: Unable to recover: %v", truncErr)
+				}
+				break
+			}
+			return nil, fmt.Errorf("raft: Corrupt entry at offset %d, followed by more data: %v", goodOffset, err)
+		}
+
+		entries = append(entries, entry)
+		goodOffset += int64(n)
+	}
+
+	return entries, nil
+}
+
+// verifyFrames scans the frames in path, without mutating the file, and
+// reports the first one that can't be read back (a CRC mismatch, an
+// oversized or truncated frame, or an undecodable entry). Scanning stops
+// there, so at most one range is reported and records after it are not
+// checked.
+func verifyFrames(path string) ([]CorruptRange, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var ranges []CorruptRange
+	var offset int64
+
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+
+		_, n, err := readFrame(reader)
+		if err != nil && err != io.EOF {
+			ranges = append(ranges, CorruptRange{StartOffset: offset, EndOffset: offset + int64(n), Err: err})
+			// Without trustworthy framing we can't know where the next
+			// record starts; stop scanning this file once we've hit
+			// corruption, same as readAllFrames does for recovery.
+			break
+		}
+		offset += int64(n)
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Regression test: a corrupted length field in a non-tail frame's header
+// used to read straight through whatever well-framed records followed it,
+// landing exactly at EOF and making readAllFrames mistake the swallowed,
+// committed records for a safe-to-truncate tail write. Flipping only the
+// length field (leaving its CRC untouched) of the middle frame in a
+// three-frame file must surface a hard error instead of silently dropping
+// the last, CRC-valid frame.
+func TestReadAllFrames_LengthFieldCorruptionInMiddleIsHardError(t *testing.T) {
+	l := newTestLog()
+	var entries []*LogEntry
+	for _, data := range []string{"one", "two", "three"} {
+		entry := l.createEntry(1, &testCommand{Data: data})
+		if err := l.appendEntries([]*LogEntry{entry}); err != nil {
+			t.Fatalf("appendEntries: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	path := filepath.Join(t.TempDir(), "log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	var frameOffsets []int64
+	for _, entry := range entries {
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		frameOffsets = append(frameOffsets, offset)
+		if err := writeFrame(file, entry); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Grow the second frame's declared length so it reads through the rest
+	// of frame two's real payload and all of frame three, landing exactly
+	// at EOF. Its CRC (bytes 4:8 of its header) is left untouched, so it's
+	// guaranteed to mismatch once the overlong payload is read.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	secondFrameOffset := frameOffsets[1]
+	corruptedLength := uint32(info.Size() - secondFrameOffset - frameHeaderSize)
+
+	file, err = os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	var lengthBytes [4]byte
+	binary.LittleEndian.PutUint32(lengthBytes[:], corruptedLength)
+	if _, err := file.WriteAt(lengthBytes[:], secondFrameOffset); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := readAllFrames(file); err == nil {
+		t.Fatalf("readAllFrames: expected a hard error from the swallowed third frame, got nil")
+	}
+
+	// The file on disk must be untouched: a hard error must never truncate.
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size() != offset {
+		t.Fatalf("expected file size to remain %d, got %d", offset, info.Size())
+	}
+}
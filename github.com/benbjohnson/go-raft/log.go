@@ -1,11 +1,7 @@
 package raft
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
-	"io"
-	"os"
 	"sync"
 )
 
@@ -16,16 +12,44 @@ import (
 //------------------------------------------------------------------------------
 
 // A log is a collection of log entries that are persisted to durable storage.
+// Persistence itself is delegated to a Storage implementation so that the
+// Log is agnostic to whatever backs it (a single file, a directory of
+// segments, BoltDB, an in-memory slice, ...).
+//
+// The log tracks three distinct positions, in the order they occur:
+// applied <= commitIndex <= currentIndex. An entry is held in memory once
+// it's appended, committed (and written to storage by setCommitIndex) once
+// a quorum has acknowledged it, and applied once the state machine has
+// actually seen it. setCommitIndex only advances
+// commitIndex; applying is driven separately through NextAppliableEntries
+// and SetAppliedIndex so a slow state machine never blocks the commit path.
 type Log struct {
 	ApplyFunc   func(Command) (interface{}, error)
-	file        *os.File
-	path        string
+	storage     Storage
 	entries     []*LogEntry
 	results     []*logResult
 	commitIndex uint64
+	applied     uint64
 	mutex       sync.RWMutex
 	startIndex  uint64 // the index before the first entry in the Log entries
 	startTerm   uint64
+
+	// SnapshotThreshold, when non-zero, is the number of applied entries
+	// since the last snapshot at which the log automatically snapshots
+	// itself. SnapshotFunc must be set to use it.
+	SnapshotThreshold uint64
+
+	// SnapshotFunc, if set, is called to obtain a serialized snapshot of
+	// the state machine when SnapshotThreshold is exceeded.
+	SnapshotFunc func() ([]byte, error)
+
+	// RestoreFunc, if set, is called with the bytes of the newest snapshot
+	// found by the storage when the log is opened.
+	RestoreFunc func([]byte) error
+
+	// chunkGroups buffers the chunks of any in-flight ChunkedCommand,
+	// keyed by chunk group ID. See chunking.go.
+	chunkGroups map[string]*chunkGroup
 }
 
 // The results of the applying a log entry.
@@ -40,10 +64,18 @@ type logResult struct {
 //
 //------------------------------------------------------------------------------
 
-// Creates a new log.
+// Creates a new log backed by a FileStorage, preserving the historical
+// single-file behavior.
 func newLog() *Log {
+	return newLogWithStorage(NewFileStorage())
+}
+
+// Creates a new log backed by the given Storage.
+func newLogWithStorage(storage Storage) *Log {
 	return &Log{
-		entries: make([]*LogEntry, 0),
+		storage:     storage,
+		entries:     make([]*LogEntry, 0),
+		chunkGroups: make(map[string]*chunkGroup),
 	}
 }
 
@@ -132,75 +164,88 @@ func (l *Log) currentTerm() uint64 {
 // State
 //--------------------------------------
 
-// Opens the log file and reads existing entries. The log can remain open and
-// continue to append entries to the end of the log.
+// Opens the log storage and reads existing entries. The log can remain open
+// and continue to append entries to the end of the log.
 func (l *Log) open(path string) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	// Read all the entries from the log if one exists.
-	var lastIndex int = 0
-	if _, err := os.Stat(path); !os.IsNotExist(err) {
-		// Open the log file.
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-
-		// Read the file and decode entries.
-		for {
-			if _, err := reader.Peek(1); err == io.EOF {
-				break
-			}
-
-			// Instantiate log entry and decode into it.
-			entry := newLogEntry(l, 0, 0, nil)
-			n, err := entry.decode(reader)
-			if err != nil {
-				file.Close()
-				if err = os.Truncate(path, int64(lastIndex)); err != nil {
-					return fmt.Errorf("raft.Log: Unable to recover: %v", err)
-				}
-				break
-			}
-
-			// Append entry.
-			l.entries = append(l.entries, entry)
-			l.commitIndex = entry.Index
-
-			// Apply the command.
-			returnValue, err := l.ApplyFunc(entry.Command)
-			l.results = append(l.results, &logResult{returnValue: returnValue, err: err})
+	if err := l.storage.Open(path); err != nil {
+		return err
+	}
 
-			lastIndex += n
+	// If the storage holds a snapshot, restore the state machine from it
+	// before replaying whatever entries came after it.
+	snapTerm, snapIndex, snapData, err := l.storage.LoadSnapshot()
+	if err != nil && err != errSnapshotsUnsupported {
+		return err
+	}
+	if snapIndex > 0 {
+		if l.RestoreFunc == nil {
+			return fmt.Errorf("raft.Log: Storage has a snapshot but no RestoreFunc is set")
+		}
+		if err := l.RestoreFunc(snapData); err != nil {
+			return err
 		}
+		l.startIndex = snapIndex
+		l.startTerm = snapTerm
+		l.commitIndex = snapIndex
+		l.applied = snapIndex
+	}
 
-		file.Close()
+	lastIndex, err := l.storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	if lastIndex <= l.startIndex {
+		return nil
 	}
 
-	// Open the file for appending.
-	var err error
-	l.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	entries, err := l.storage.Entries(l.startIndex+1, lastIndex+1)
 	if err != nil {
 		return err
 	}
-	l.path = path
+
+	// Replay the entries already on disk, applying each to the state
+	// machine and recording its result. Entries on disk were written by
+	// setCommitIndex, so they're all committed, and since each is applied
+	// here, applied and commitIndex both advance together.
+	for _, entry := range entries {
+		entry.log = l
+		l.entries = append(l.entries, entry)
+		l.commitIndex = entry.Index
+
+		returnValue, err := l.applyCommand(entry)
+		l.results = append(l.results, &logResult{returnValue: returnValue, err: err})
+	}
+	l.applied = l.commitIndex
+
 	return nil
 }
 
-// Closes the log file.
+// Closes the log storage.
 func (l *Log) close() {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if l.file != nil {
-		l.file.Close()
-		l.file = nil
+	if l.storage != nil {
+		l.storage.Close()
 	}
 	l.entries = make([]*LogEntry, 0)
 	l.results = make([]*logResult, 0)
+	l.applied = 0
+	l.chunkGroups = make(map[string]*chunkGroup)
+}
+
+// Scans the whole log via the storage and reports any corrupt entry ranges
+// found. This does not repair anything; it's a diagnostic for operators who
+// hit the hard-error path during open() and need to know how much of the
+// log, and where, is affected. FileStorage and DirStorage stop scanning at
+// the first corrupt frame, so they report at most one range.
+func (l *Log) Verify() ([]CorruptRange, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.storage.Verify()
 }
 
 //--------------------------------------
@@ -221,7 +266,7 @@ func (l *Log) getEntry(index uint64) *LogEntry {
 	if index <= l.startIndex || index > (l.startIndex+uint64(len(l.entries))) {
 		return nil
 	}
-	return l.entries[index-1]
+	return l.entries[index-1-l.startIndex]
 }
 
 // Checks if the log contains a given index/term combination.
@@ -271,8 +316,8 @@ func (l *Log) getEntryResult(entry *LogEntry, clear bool) (interface{}, error) {
 	}
 
 	// If a result exists for the entry then return it with its error.
-	if entry.Index > 0 && entry.Index <= uint64(len(l.results)) {
-		if result := l.results[entry.Index-1]; result != nil {
+	if entry.Index > l.startIndex && entry.Index <= l.startIndex+uint64(len(l.results)) {
+		if result := l.results[entry.Index-1-l.startIndex]; result != nil {
 
 			// keep the records before remove it
 			returnValue, err := result.returnValue, result.err
@@ -335,7 +380,11 @@ func (l *Log) updateCommitIndex(index uint64) {
 	l.commitIndex = index
 }
 
-// Updates the commit index and writes entries after that index to the stable storage.
+// Updates the commit index and writes entries after that index to the stable
+// storage. This only persists entries and advances commitIndex; it does not
+// touch the state machine. Applying committed entries is the job of
+// whatever goroutine drains NextAppliableEntries and calls SetAppliedIndex,
+// so a slow ApplyFunc can never stall the commit/replication path.
 func (l *Log) setCommitIndex(index uint64) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -369,20 +418,126 @@ func (l *Log) setCommitIndex(index uint64) error {
 		entry := l.entries[entryIndex]
 
 		// Write to storage.
-		if err := entry.encode(l.file); err != nil {
+		if err := l.storage.Append([]*LogEntry{entry}); err != nil {
 			return err
 		}
 
-		// Update commit index.
+		// Update commit index. The result slot is left nil until the
+		// entry is actually applied; see SetEntryResult.
 		l.commitIndex = entry.Index
+		l.results[entryIndex] = nil
+	}
 
-		// Apply the changes to the state machine and store the error code.
-		returnValue, err := l.ApplyFunc(entry.Command)
-		l.results[entryIndex] = &logResult{returnValue: returnValue, err: err}
+	return nil
+}
+
+// Takes a snapshot via SnapshotFunc, persists it through the storage, and
+// drops the log entries it now covers. Unlike the old compact() (see the
+// note under "Log compaction" below), this doesn't have
+// to rewrite the surviving entries: SaveSnapshot only writes the (usually
+// empty) tail after the snapshotted index, so the cost no longer scales
+// with the number of entries already compacted away.
+//
+// The snapshot can only cover entries up to l.applied, never up to
+// l.commitIndex: SnapshotFunc serializes whatever the state machine has
+// actually seen, and per the applied <= commitIndex invariant there may be
+// committed entries the apply goroutine hasn't gotten to yet. Callers must
+// ensure l.applied > l.startIndex before calling this.
+func (l *Log) snapshot() error {
+	data, err := l.SnapshotFunc()
+	if err != nil {
+		return err
+	}
+
+	term := l.entries[l.applied-l.startIndex-1].Term
+	if err := l.storage.SaveSnapshot(term, l.applied, data); err != nil {
+		return err
 	}
+
+	survivors := l.entries[l.applied-l.startIndex:]
+	survivorResults := l.results[l.applied-l.startIndex:]
+	l.entries = survivors
+	l.results = survivorResults
+	l.startIndex = l.applied
+	l.startTerm = term
 	return nil
 }
 
+//--------------------------------------
+// Apply
+//--------------------------------------
+
+// The last index applied to the state machine. applied <= CommitIndex()
+// always holds.
+func (l *Log) AppliedIndex() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.applied
+}
+
+// Advances the applied index. This is called by whatever goroutine owns
+// invoking ApplyFunc (normally the server, not the log) once it has applied
+// the entries returned by NextAppliableEntries up to and including index.
+func (l *Log) SetAppliedIndex(index uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if index > l.commitIndex {
+		return fmt.Errorf("raft.Log: Applied index (%d) cannot be past commit index (%d)", index, l.commitIndex)
+	}
+	if index < l.applied {
+		return nil
+	}
+	l.applied = index
+
+	// Snapshot automatically once enough applied entries have piled up
+	// since the last one, so callers never have to trigger compaction
+	// themselves. This is checked here, not in setCommitIndex, because the
+	// snapshot can only ever cover what's actually been applied. It's held
+	// off while any chunk group is still being assembled: a group's earlier
+	// chunks may already be applied (and so eligible for snapshotting) but
+	// its later, uncommitted chunks are not, and SnapshotFunc has no way to
+	// capture the partially-buffered group itself, so snapshotting here
+	// would lose it across a restart.
+	if l.SnapshotThreshold > 0 && l.SnapshotFunc != nil && len(l.chunkGroups) == 0 && l.applied-l.startIndex >= l.SnapshotThreshold {
+		if err := l.snapshot(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Records the return value and error produced by applying the entry at
+// index to the state machine. This is separate from SetAppliedIndex so the
+// caller can record every entry's result before advancing applied in a
+// batch.
+func (l *Log) SetEntryResult(index uint64, returnValue interface{}, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if index <= l.startIndex || index > l.startIndex+uint64(len(l.results)) {
+		return
+	}
+	l.results[index-1-l.startIndex] = &logResult{returnValue: returnValue, err: err}
+}
+
+// Returns the committed-but-not-yet-applied entries, in order. The caller is
+// expected to invoke Apply (not ApplyFunc directly, so chunked commands are
+// reassembled) on each, record its result with SetEntryResult, and advance
+// the log with SetAppliedIndex.
+func (l *Log) NextAppliableEntries() []*LogEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.applied >= l.commitIndex {
+		return nil
+	}
+	lo := l.applied + 1 - l.startIndex
+	hi := l.commitIndex - l.startIndex
+	return l.entries[lo-1 : hi]
+}
+
 //--------------------------------------
 // Truncation
 //--------------------------------------
@@ -424,6 +579,10 @@ func (l *Log) truncate(index uint64, term uint64) error {
 		}
 	}
 
+	// Any chunk group with a chunk after index can no longer be completed
+	// as originally sent; drop its buffered chunks.
+	l.dropTruncatedChunkGroups(index)
+
 	return nil
 }
 
@@ -451,8 +610,8 @@ func (l *Log) appendEntries(entries []*LogEntry) error {
 // obtain a lock and should only be used internally. Use AppendEntries() and
 // AppendEntry() to use it externally.
 func (l *Log) appendEntry(entry *LogEntry) error {
-	if l.file == nil {
-		return errors.New("raft.Log: Log is not open")
+	if l.storage == nil {
+		return errNotOpen
 	}
 
 	// Make sure the term and index are greater than the previous.
@@ -476,54 +635,10 @@ func (l *Log) appendEntry(entry *LogEntry) error {
 // Log compaction
 //--------------------------------------
 
-// compaction the log before index
-func (l *Log) compact(index uint64, term uint64) error {
-	var entries []*LogEntry
-
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
-	// nothing to compaction
-	// the index may be greater than the current index if
-	// we just recovery from on snapshot
-	if index >= l.internalCurrentIndex() {
-		entries = make([]*LogEntry, 0)
-	} else {
-
-		// get all log entries after index
-		entries = l.entries[index-l.startIndex:]
-	}
-
-	// create a new log file and add all the entries
-	file, err := os.OpenFile(l.path+".new", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
-	}
-	for _, entry := range entries {
-		err = entry.encode(file)
-		if err != nil {
-			return err
-		}
-	}
-	// close the current log file
-	l.file.Close()
-
-	// remove the current log file to .bak
-	err = os.Remove(l.path)
-	if err != nil {
-		return err
-	}
-
-	// rename the new log file
-	err = os.Rename(l.path+".new", l.path)
-	if err != nil {
-		return err
-	}
-	l.file = file
-
-	// compaction the in memory log
-	l.entries = entries
-	l.startIndex = index
-	l.startTerm = term
-	return nil
-}
+// Manual compaction has been superseded by automatic, SnapshotFunc-driven
+// snapshotting (see snapshot(), triggered from SetAppliedIndex). The old
+// compact() rewrote storage directly and never went through
+// Storage.SaveSnapshot, so storage implementations that track a real
+// snapshot (DirStorage) were left with a stale FirstIndex()/snapshot after
+// a compact() call, making the log unopenable afterward. Callers that need
+// to bound log growth should set SnapshotThreshold/SnapshotFunc instead.
@@ -0,0 +1,337 @@
+package raft
+
+import (
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+// testCommand is a minimal Command used only by this package's tests.
+type testCommand struct {
+	Data string
+}
+
+func (c *testCommand) CommandName() string {
+	return "test:command"
+}
+
+func init() {
+	gob.Register(&testCommand{})
+}
+
+// newTestLog returns a Log backed by MemoryStorage, so these tests never
+// touch disk.
+func newTestLog() *Log {
+	l := newLogWithStorage(NewMemoryStorage())
+	l.ApplyFunc = func(c Command) (interface{}, error) { return nil, nil }
+	return l
+}
+
+func TestLog_SetCommitIndexDoesNotApplySynchronously(t *testing.T) {
+	l := newTestLog()
+	applyCount := 0
+	l.ApplyFunc = func(c Command) (interface{}, error) {
+		applyCount++
+		return nil, nil
+	}
+
+	entry := l.createEntry(1, &testCommand{Data: "a"})
+	if err := l.appendEntries([]*LogEntry{entry}); err != nil {
+		t.Fatalf("appendEntries: %v", err)
+	}
+	if err := l.setCommitIndex(1); err != nil {
+		t.Fatalf("setCommitIndex: %v", err)
+	}
+
+	if applyCount != 0 {
+		t.Fatalf("setCommitIndex must not invoke ApplyFunc directly, got %d calls", applyCount)
+	}
+	if l.CommitIndex() != 1 {
+		t.Fatalf("expected commit index 1, got %d", l.CommitIndex())
+	}
+	if l.AppliedIndex() != 0 {
+		t.Fatalf("expected applied index 0 before draining, got %d", l.AppliedIndex())
+	}
+
+	appliable := l.NextAppliableEntries()
+	if len(appliable) != 1 {
+		t.Fatalf("expected 1 appliable entry, got %d", len(appliable))
+	}
+
+	if _, err := l.Apply(appliable[0]); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := l.SetAppliedIndex(appliable[0].Index); err != nil {
+		t.Fatalf("SetAppliedIndex: %v", err)
+	}
+
+	if applyCount != 1 {
+		t.Fatalf("expected exactly 1 apply after draining, got %d", applyCount)
+	}
+	if l.AppliedIndex() != 1 {
+		t.Fatalf("expected applied index 1, got %d", l.AppliedIndex())
+	}
+}
+
+// Regression test: automatic snapshotting used to trigger off commitIndex
+// inside setCommitIndex, before anything had been applied, which violated
+// the applied <= commitIndex <= currentIndex invariant and made
+// NextAppliableEntries panic with a slice-bounds underflow. This uses a
+// real DirStorage (the only Storage here that implements SaveSnapshot) so
+// the snapshot path genuinely fires, same as the reported repro.
+func TestLog_SnapshotDoesNotOutrunAppliedIndex(t *testing.T) {
+	l := newLogWithStorage(NewDirStorage())
+	l.ApplyFunc = func(c Command) (interface{}, error) { return nil, nil }
+	if err := l.open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	l.SnapshotThreshold = 2
+	l.SnapshotFunc = func() ([]byte, error) { return []byte("snapshot"), nil }
+
+	for i := 0; i < 3; i++ {
+		entry := l.createEntry(1, &testCommand{Data: "x"})
+		if err := l.appendEntries([]*LogEntry{entry}); err != nil {
+			t.Fatalf("appendEntries: %v", err)
+		}
+	}
+	if err := l.setCommitIndex(3); err != nil {
+		t.Fatalf("setCommitIndex: %v", err)
+	}
+
+	// Nothing has been applied yet, so no snapshot should have fired even
+	// though commitIndex (3) is past SnapshotThreshold (2).
+	appliable := l.NextAppliableEntries()
+	if len(appliable) != 3 {
+		t.Fatalf("expected all 3 committed entries still appliable, got %d", len(appliable))
+	}
+
+	for _, entry := range appliable {
+		if _, err := l.Apply(entry); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		if err := l.SetAppliedIndex(entry.Index); err != nil {
+			t.Fatalf("SetAppliedIndex: %v", err)
+		}
+	}
+
+	if l.AppliedIndex() != 3 {
+		t.Fatalf("expected applied index 3, got %d", l.AppliedIndex())
+	}
+}
+
+// Regression test: getEntry and getEntryResult used to index l.entries and
+// l.results with the absolute, pre-snapshot index instead of shifting by
+// l.startIndex like SetEntryResult already did. Once snapshot() re-slices
+// both down to the post-snapshot entries, that absolute indexing either
+// panics (getEntry) or silently returns a nil result for a real, applied
+// command (getEntryResult).
+func TestLog_GetEntryAndResultAfterSnapshot(t *testing.T) {
+	l := newLogWithStorage(NewDirStorage())
+	l.ApplyFunc = func(c Command) (interface{}, error) {
+		return c.(*testCommand).Data, nil
+	}
+	if err := l.open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	l.SnapshotThreshold = 2
+	l.SnapshotFunc = func() ([]byte, error) { return []byte("snapshot"), nil }
+
+	for i := 0; i < 3; i++ {
+		entry := l.createEntry(1, &testCommand{Data: "x"})
+		if err := l.appendEntries([]*LogEntry{entry}); err != nil {
+			t.Fatalf("appendEntries: %v", err)
+		}
+	}
+	if err := l.setCommitIndex(3); err != nil {
+		t.Fatalf("setCommitIndex: %v", err)
+	}
+
+	for _, entry := range l.NextAppliableEntries() {
+		returnValue, err := l.Apply(entry)
+		if err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		l.SetEntryResult(entry.Index, returnValue, nil)
+		if err := l.SetAppliedIndex(entry.Index); err != nil {
+			t.Fatalf("SetAppliedIndex: %v", err)
+		}
+	}
+
+	// applied reached SnapshotThreshold (2) at entry 2, so the snapshot
+	// above should have fired there and shifted l.startIndex/re-sliced
+	// l.entries and l.results, leaving entry 3 as the only survivor.
+	if l.startIndex == 0 {
+		t.Fatalf("expected snapshot to advance startIndex, got 0")
+	}
+
+	entry := l.getEntry(3)
+	if entry == nil {
+		t.Fatalf("getEntry(3): expected surviving entry, got nil")
+	}
+	if entry.Index != 3 {
+		t.Fatalf("getEntry(3): expected entry with index 3, got %d", entry.Index)
+	}
+
+	returnValue, err := l.getEntryResult(entry, false)
+	if err != nil {
+		t.Fatalf("getEntryResult: %v", err)
+	}
+	if returnValue != "x" {
+		t.Fatalf("getEntryResult: expected recorded return value %q, got %v", "x", returnValue)
+	}
+}
+
+// Regression test: appendChunkedCommand used to derive every chunk's index
+// from l.nextIndex() inside the loop, which doesn't change until
+// appendEntries is called, so every chunk after the first got the same
+// index and appendEntries rejected it.
+func TestLog_AppendChunkedCommandReassembles(t *testing.T) {
+	l := newTestLog()
+	var applied []string
+	l.ApplyFunc = func(c Command) (interface{}, error) {
+		applied = append(applied, c.(*testCommand).Data)
+		return nil, nil
+	}
+
+	data := strings.Repeat("x", 100)
+	if err := l.appendChunkedCommand(1, &testCommand{Data: data}, 8); err != nil {
+		t.Fatalf("appendChunkedCommand: %v", err)
+	}
+
+	lastIndex := l.currentIndex()
+	if lastIndex < 2 {
+		t.Fatalf("expected a large command to split into multiple entries, got currentIndex %d", lastIndex)
+	}
+
+	if err := l.setCommitIndex(lastIndex); err != nil {
+		t.Fatalf("setCommitIndex: %v", err)
+	}
+	for _, entry := range l.NextAppliableEntries() {
+		if _, err := l.Apply(entry); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+	}
+
+	if len(applied) != 1 {
+		t.Fatalf("expected the reassembled command to be applied exactly once, got %d applies", len(applied))
+	}
+	if applied[0] != data {
+		t.Fatalf("reassembled command data mismatch: got %d bytes, want %d", len(applied[0]), len(data))
+	}
+}
+
+// Regression test: the chunk group ID used to be derived from l.nextIndex()
+// at call time, so a leader retrying the exact same append produced a
+// different ID each time, breaking the "idempotent by chunk-group ID"
+// requirement.
+func TestLog_AppendChunkedCommandGroupIDStableAcrossRetries(t *testing.T) {
+	l := newTestLog()
+	cmd := &testCommand{Data: strings.Repeat("y", 40)}
+
+	if err := l.appendChunkedCommand(1, cmd, 8); err != nil {
+		t.Fatalf("appendChunkedCommand (first attempt): %v", err)
+	}
+	firstGroupID := l.entries[0].Command.(*ChunkedCommand).GroupID
+
+	firstAttemptLen := len(l.entries)
+	if err := l.appendChunkedCommand(1, cmd, 8); err != nil {
+		t.Fatalf("appendChunkedCommand (retry): %v", err)
+	}
+	retryGroupID := l.entries[firstAttemptLen].Command.(*ChunkedCommand).GroupID
+
+	if firstGroupID != retryGroupID {
+		t.Fatalf("expected a retry of the same command to reuse the chunk group ID, got %q vs %q", firstGroupID, retryGroupID)
+	}
+}
+
+// Regression test: bufferChunk used to remember every GroupID it had ever
+// fully reassembled (keyed purely off a hash of the encoded command) and
+// permanently refuse to apply it again. GroupID is content-derived, so two
+// logically distinct commands that happen to serialize to identical bytes
+// (e.g. two client writes with no unique nonce) would collide on it: the
+// second, entirely independent append silently never reached ApplyFunc.
+// bufferChunk must apply each append that still has chunks to reassemble,
+// regardless of whether an earlier append produced the same GroupID.
+func TestLog_AppendChunkedCommandAppliesEachDistinctAppend(t *testing.T) {
+	l := newTestLog()
+	applyCount := 0
+	l.ApplyFunc = func(c Command) (interface{}, error) {
+		applyCount++
+		return nil, nil
+	}
+
+	// Same content each time, standing in for two unrelated client writes
+	// that happen to coincide.
+	cmd := &testCommand{Data: strings.Repeat("z", 40)}
+
+	for i := 0; i < 2; i++ {
+		if err := l.appendChunkedCommand(1, cmd, 8); err != nil {
+			t.Fatalf("appendChunkedCommand (append %d): %v", i, err)
+		}
+		if err := l.setCommitIndex(l.currentIndex()); err != nil {
+			t.Fatalf("setCommitIndex: %v", err)
+		}
+		for _, entry := range l.NextAppliableEntries() {
+			if _, err := l.Apply(entry); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if err := l.SetAppliedIndex(entry.Index); err != nil {
+				t.Fatalf("SetAppliedIndex: %v", err)
+			}
+		}
+	}
+
+	if applyCount != 2 {
+		t.Fatalf("expected both independent appends to be applied, got %d applies", applyCount)
+	}
+}
+
+// Regression test: dropTruncatedChunkGroups must only drop a chunk group
+// whose span reaches strictly past the truncation point. truncate(index,
+// term) keeps the entry at index and discards only what follows it, so a
+// group whose last chunk sits exactly at index has nothing truncated out
+// from under it and must be left buffered. This boundary (`>` vs the prior
+// `>=`) was the subject of two earlier fix commits, so it's pinned here.
+func TestLog_TruncateDropsOnlyChunkGroupsThatReachPastIndex(t *testing.T) {
+	l := newTestLog()
+
+	// A 3-chunk group spanning indices 1-3 (the command gob-encodes to 85
+	// bytes, so 32-byte chunks give exactly 3).
+	if err := l.appendChunkedCommand(1, &testCommand{Data: strings.Repeat("a", 24)}, 32); err != nil {
+		t.Fatalf("appendChunkedCommand: %v", err)
+	}
+	if l.currentIndex() != 3 {
+		t.Fatalf("expected a 3-chunk group spanning indices 1-3, got currentIndex %d", l.currentIndex())
+	}
+	groupID := l.entries[0].Command.(*ChunkedCommand).GroupID
+
+	// Chunks are only buffered in l.chunkGroups once applied, so commit and
+	// apply the first chunk to start buffering the group.
+	if err := l.setCommitIndex(1); err != nil {
+		t.Fatalf("setCommitIndex: %v", err)
+	}
+	if _, err := l.Apply(l.entries[0]); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, ok := l.chunkGroups[groupID]; !ok {
+		t.Fatalf("expected group %q to be buffered after applying its first chunk", groupID)
+	}
+
+	// Truncating at the group's last index (3) discards nothing of the
+	// group: it must survive.
+	if err := l.truncate(3, 1); err != nil {
+		t.Fatalf("truncate(3): %v", err)
+	}
+	if _, ok := l.chunkGroups[groupID]; !ok {
+		t.Fatalf("truncate(3): expected group %q to survive a truncation at its own last index", groupID)
+	}
+
+	// Truncating at index 2 discards the group's last chunk (index 3): the
+	// group can never be completed as sent and must be dropped.
+	if err := l.truncate(2, 1); err != nil {
+		t.Fatalf("truncate(2): %v", err)
+	}
+	if _, ok := l.chunkGroups[groupID]; ok {
+		t.Fatalf("truncate(2): expected group %q to be dropped once its last chunk was truncated away", groupID)
+	}
+}